@@ -0,0 +1,62 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oracle composes and extracts the physical and logical parts of a
+// TSO value, and converts between a TSO and a Go time.
+package oracle
+
+import "time"
+
+const (
+	// PhysicalShiftBits is the width, in bits, of the logical part of a TSO.
+	// Variants of TimestampOracle that steal low bits of the logical part for
+	// their own use (e.g. a local-allocator or keyspace ID) should derive
+	// their own bit widths from this constant rather than hardcoding 18.
+	PhysicalShiftBits = 18
+	// MaxLogical is the exclusive upper bound of the logical part of a TSO.
+	MaxLogical = int64(1) << PhysicalShiftBits
+)
+
+// ComposeTS merges a physical time (in milliseconds since the Unix epoch) and
+// a logical counter into a single 64-bit TSO value.
+func ComposeTS(physical, logical int64) uint64 {
+	return uint64((physical << PhysicalShiftBits) + logical)
+}
+
+// ExtractPhysical returns the physical part of a TSO value, in milliseconds
+// since the Unix epoch.
+func ExtractPhysical(ts uint64) int64 {
+	return int64(ts >> PhysicalShiftBits)
+}
+
+// ExtractLogical returns the logical part of a TSO value.
+func ExtractLogical(ts uint64) int64 {
+	return int64(ts) & (MaxLogical - 1)
+}
+
+// GetPhysical returns t as milliseconds since the Unix epoch, the unit the
+// physical part of a TSO is expressed in.
+func GetPhysical(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// GoTimeToTS converts a Go time to a TSO with a zero logical part.
+func GoTimeToTS(t time.Time) uint64 {
+	return ComposeTS(GetPhysical(t), 0)
+}
+
+// GetTimeFromTS extracts the physical part of a TSO as a Go time.
+func GetTimeFromTS(ts uint64) time.Time {
+	ms := ExtractPhysical(ts)
+	return time.Unix(ms/1e3, (ms%1e3)*int64(time.Millisecond))
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oracle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComposeAndExtract(t *testing.T) {
+	physical := time.Now().UnixNano() / int64(time.Millisecond)
+	logical := int64(123)
+
+	ts := ComposeTS(physical, logical)
+	if got := ExtractPhysical(ts); got != physical {
+		t.Fatalf("ExtractPhysical() = %d, want %d", got, physical)
+	}
+	if got := ExtractLogical(ts); got != logical {
+		t.Fatalf("ExtractLogical() = %d, want %d", got, logical)
+	}
+}
+
+func TestGoTimeToTSRoundTrip(t *testing.T) {
+	now := time.Now()
+	ts := GoTimeToTS(now)
+	got := GetTimeFromTS(ts)
+	if got.UnixNano()/int64(time.Millisecond) != now.UnixNano()/int64(time.Millisecond) {
+		t.Fatalf("GetTimeFromTS(GoTimeToTS(now)) = %v, want %v", got, now)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+)
+
+const (
+	// defaultMaxBatchSize caps how many pending requests a single dispatcher
+	// tick will coalesce into one GetRespTS call.
+	defaultMaxBatchSize = 1000
+	// defaultBatchInterval is how long the dispatcher waits to accumulate a
+	// batch before flushing whatever it has.
+	defaultBatchInterval = time.Millisecond
+	// requestQueueSize bounds how many unbatched requests may be outstanding
+	// before AsyncRequest blocks the caller.
+	requestQueueSize = 10000
+)
+
+// TSResult is the outcome of a batched TSO request: either the first
+// timestamp of a `count`-sized contiguous range, or an error.
+type TSResult struct {
+	Physical int64
+	// Logical is the logical part of the *first* timestamp granted to this
+	// request; the request owns the `count` logical values starting here.
+	Logical int64
+	Err     error
+}
+
+// tsoRequest is a single caller's request for `count` contiguous timestamps,
+// queued up for the dispatcher goroutine to batch together with others.
+type tsoRequest struct {
+	count      uint32
+	enqueuedAt time.Time
+	replyCh    chan TSResult
+}
+
+// Dispatcher batches concurrent TSO requests from many gRPC handlers into a
+// single atomic.AddInt64 on the oracle's logical part per tick, amortizing
+// contention on `t.ts`. It does not change how often saveTimestamp runs:
+// GetRespTS never saves, only UpdateTimestamp and SyncTimestamp do.
+type Dispatcher struct {
+	oracle        *TimestampOracle
+	maxBatchSize  int
+	batchInterval time.Duration
+
+	requestCh chan *tsoRequest
+	closeCh   chan struct{}
+
+	mu struct {
+		sync.RWMutex
+		closed bool
+	}
+}
+
+// NewDispatcher creates a Dispatcher that serves batched TSO requests out of
+// oracle. Call Run in its own goroutine to start serving, and Close to stop.
+func NewDispatcher(oracle *TimestampOracle) *Dispatcher {
+	return &Dispatcher{
+		oracle:        oracle,
+		maxBatchSize:  defaultMaxBatchSize,
+		batchInterval: defaultBatchInterval,
+		requestCh:     make(chan *tsoRequest, requestQueueSize),
+		closeCh:       make(chan struct{}),
+	}
+}
+
+// AsyncRequest enqueues a request for `count` contiguous timestamps and
+// returns a channel that receives the single TSResult once the dispatcher has
+// batched and served it.
+func (d *Dispatcher) AsyncRequest(count uint32) <-chan TSResult {
+	req := &tsoRequest{
+		count:      count,
+		enqueuedAt: time.Now(),
+		replyCh:    make(chan TSResult, 1),
+	}
+
+	// Holding the read lock across the send ensures it either completes
+	// before Close takes the write lock and closes requestCh's reader, or
+	// observes d.mu.closed and never sends at all — closing-in-flight can
+	// never enqueue a request that nothing will ever read.
+	d.mu.RLock()
+	closed := d.mu.closed
+	if !closed {
+		d.requestCh <- req
+	}
+	d.mu.RUnlock()
+
+	if closed {
+		req.replyCh <- TSResult{Err: errors.New("tso dispatcher is closed")}
+	}
+	return req.replyCh
+}
+
+// HandleTSORequest serves one gRPC Tso stream request's worth of count
+// timestamps through the batching dispatcher, blocking until the batch it's
+// coalesced into has been served. server/grpc_service.go's Tso handler
+// should call this for every pdpb.TsoRequest instead of calling
+// TimestampOracle.GetRespTS directly, so concurrent streams all batch
+// through the same dispatcher rather than contending on the oracle one
+// request at a time. The returned Timestamp carries the *first* of the count
+// logical values granted, whereas GetRespTS returns the last; the two agree
+// only when count is 1.
+func (d *Dispatcher) HandleTSORequest(count uint32) (*pdpb.Timestamp, error) {
+	result := <-d.AsyncRequest(count)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return &pdpb.Timestamp{Physical: result.Physical, Logical: result.Logical}, nil
+}
+
+// Run is the dispatcher's single consumer goroutine. It must be started
+// exactly once and runs until Close is called.
+func (d *Dispatcher) Run() {
+	ticker := time.NewTicker(d.batchInterval)
+	defer ticker.Stop()
+
+	var batch []*tsoRequest
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		d.serveBatch(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case req := <-d.requestCh:
+			batch = append(batch, req)
+			if len(batch) >= d.maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-d.closeCh:
+			flush()
+			// Drain whatever slipped into requestCh while Close was
+			// racing with an in-flight AsyncRequest, so no caller is left
+			// blocked forever on its reply channel.
+			for {
+				select {
+				case req := <-d.requestCh:
+					d.serveBatch([]*tsoRequest{req})
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close stops the dispatcher goroutine started by Run.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.mu.closed = true
+	d.mu.Unlock()
+	close(d.closeCh)
+}
+
+// serveBatch coalesces every request in the batch into a single GetRespTS
+// call against the underlying oracle, then hands each caller its own
+// sub-range of the granted logical values.
+func (d *Dispatcher) serveBatch(batch []*tsoRequest) {
+	now := time.Now()
+	tsoDispatcherBatchSize.Observe(float64(len(batch)))
+
+	var sumCount uint32
+	for _, req := range batch {
+		sumCount += req.count
+		tsoDispatcherQueueLatency.Observe(now.Sub(req.enqueuedAt).Seconds())
+	}
+
+	resp, err := d.oracle.GetRespTS(sumCount)
+	if err != nil {
+		for _, req := range batch {
+			req.replyCh <- TSResult{Err: err}
+		}
+		return
+	}
+
+	// GetRespTS returns the logical part *after* reserving sumCount values, and
+	// that value is itself the last one granted, so the first value handed out
+	// by this batch is resp.Logical - sumCount + 1.
+	logical := resp.Logical - int64(sumCount) + 1
+	for _, req := range batch {
+		req.replyCh <- TSResult{
+			Physical: resp.Physical,
+			Logical:  logical,
+		}
+		logical += int64(req.count)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	tsoDispatcherBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "pd",
+			Subsystem: "tso",
+			Name:      "dispatcher_batch_size",
+			Help:      "Bucketed histogram of the number of requests coalesced into one dispatcher batch.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+		})
+
+	tsoDispatcherQueueLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "pd",
+			Subsystem: "tso",
+			Name:      "dispatcher_queue_latency_seconds",
+			Help:      "Bucketed histogram of the time a request waits in the dispatcher queue before being served.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+		})
+)
+
+func init() {
+	prometheus.MustRegister(tsoDispatcherBatchSize)
+	prometheus.MustRegister(tsoDispatcherQueueLatency)
+}
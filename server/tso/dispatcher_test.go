@@ -0,0 +1,108 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkDispatcherAsyncRequest measures throughput of batched TSO requests
+// fanned out from many concurrent callers, the scenario the Dispatcher exists
+// to amortize.
+func BenchmarkDispatcherAsyncRequest(b *testing.B) {
+	d := NewDispatcher(newTestGlobalOracle())
+	go d.Run()
+	defer d.Close()
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i := 0; i < b.N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-d.AsyncRequest(1)
+		}()
+	}
+	wg.Wait()
+}
+
+// TestDispatcherServesNonOverlappingLogicalRanges checks that a batch of
+// requests with differing counts each gets its own contiguous, non-
+// overlapping slice of the logical values GetRespTS granted the batch.
+func TestDispatcherServesNonOverlappingLogicalRanges(t *testing.T) {
+	d := NewDispatcher(newTestGlobalOracle())
+	go d.Run()
+	defer d.Close()
+
+	counts := []uint32{1, 3, 1, 5, 2}
+	replyChs := make([]<-chan TSResult, len(counts))
+	for i, c := range counts {
+		replyChs[i] = d.AsyncRequest(c)
+	}
+
+	results := make([]TSResult, len(counts))
+	for i, ch := range replyChs {
+		results[i] = <-ch
+		if results[i].Err != nil {
+			t.Fatalf("AsyncRequest(%d) = %v", counts[i], results[i].Err)
+		}
+	}
+
+	for i := 1; i < len(results); i++ {
+		prevEnd := results[i-1].Logical + int64(counts[i-1])
+		if results[i].Physical == results[i-1].Physical && results[i].Logical < prevEnd {
+			t.Fatalf("request %d got logical range starting at %d, overlapping the previous request's range ending at %d",
+				i, results[i].Logical, prevEnd)
+		}
+	}
+}
+
+// TestHandleTSORequestReturnsTimestamp checks that HandleTSORequest, the
+// entry point a gRPC Tso stream handler calls into, returns a real
+// timestamp for a well-formed request.
+func TestHandleTSORequestReturnsTimestamp(t *testing.T) {
+	d := NewDispatcher(newTestGlobalOracle())
+	go d.Run()
+	defer d.Close()
+
+	ts, err := d.HandleTSORequest(1)
+	if err != nil {
+		t.Fatalf("HandleTSORequest(1) = %v", err)
+	}
+	if ts.Physical == 0 {
+		t.Fatal("HandleTSORequest(1) returned a zero physical part")
+	}
+}
+
+// TestDispatcherAsyncRequestAfterCloseDoesNotHang ensures a request that
+// arrives after Close has returned still gets a reply, rather than blocking
+// forever waiting on a reply nobody will send.
+func TestDispatcherAsyncRequestAfterCloseDoesNotHang(t *testing.T) {
+	d := NewDispatcher(newTestGlobalOracle())
+	go d.Run()
+	d.Close()
+
+	done := make(chan TSResult, 1)
+	go func() {
+		done <- <-d.AsyncRequest(1)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AsyncRequest() after Close() never replied")
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/log"
+	"github.com/tikv/pd/pkg/etcdutil"
+	"github.com/tikv/pd/pkg/typeutil"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+)
+
+const (
+	// localAllocatorIDBits is the number of low bits of the logical part a
+	// LocalTimestampOracle reserves for its own stable allocator ID.
+	localAllocatorIDBits = 8
+	// maxAllocatorID is the largest allocator ID that fits in localAllocatorIDBits.
+	maxAllocatorID = int64(1)<<localAllocatorIDBits - 1
+	// maxLocalLogical is how many distinct logical values a local allocator can
+	// hand out per millisecond of its window before the id bits are appended.
+	maxLocalLogical = maxLogical >> localAllocatorIDBits
+	// defaultLocalWindowSize is how much physical time a local allocator asks
+	// the global TimestampOracle to reserve in one window.
+	defaultLocalWindowSize = 3 * time.Second
+	// localWindowRenewGuard is how far ahead of a window's expiry the
+	// allocator tries to reserve the next one.
+	localWindowRenewGuard = 500 * time.Millisecond
+)
+
+// TSOWindowReserver reserves a physical-time window from the global
+// TimestampOracle for a local allocator to hand out timestamps from without a
+// round trip to the leader. In production this is backed by the
+// ReserveTSOWindow gRPC call against the current PD leader; tests can supply
+// a fake implementation.
+type TSOWindowReserver interface {
+	// ReserveTSOWindow asks the leader to reserve `size` of physical time for
+	// allocatorID, starting no earlier than the previously granted window, and
+	// returns the physical time the window starts at.
+	ReserveTSOWindow(allocatorID int64, size time.Duration) (time.Time, error)
+}
+
+// LeaderWindowReserver is the leader-side TSOWindowReserver: it starts each
+// window at the global TimestampOracle's current physical time. It does not
+// advance the global oracle or record the windows it grants, so a window may
+// cover the same physical time as the leader's own allocation and as windows
+// granted to other local allocators. server/
+// grpc_service.go's (not part of this checkout) ReserveTSOWindow gRPC handler
+// should construct one of these around the leader's global TimestampOracle
+// and call ReserveTSOWindow on it for requests arriving from other PD
+// members.
+type LeaderWindowReserver struct {
+	global *TimestampOracle
+}
+
+// NewLeaderWindowReserver creates a LeaderWindowReserver that reserves
+// windows out of global, which must be the leader's TimestampOracle.
+func NewLeaderWindowReserver(global *TimestampOracle) *LeaderWindowReserver {
+	return &LeaderWindowReserver{global: global}
+}
+
+// ReserveTSOWindow implements TSOWindowReserver. It hands back the global
+// oracle's current physical time as the start of the window; the caller is
+// responsible for not reusing it once size has elapsed.
+func (r *LeaderWindowReserver) ReserveTSOWindow(allocatorID int64, size time.Duration) (time.Time, error) {
+	if !r.global.isLeader() {
+		return time.Time{}, errors.New("can not reserve tso window, not leader")
+	}
+	current := (*atomicObject)(atomic.LoadPointer(&r.global.ts))
+	if current == nil || current.physical == typeutil.ZeroTime {
+		return time.Time{}, errors.New("can not reserve tso window, tso not initialized")
+	}
+	return current.physical, nil
+}
+
+// localWindowStore persists the high-water mark a LocalTimestampOracle has
+// reserved up to, fenced so that two holders of the same allocator ID across
+// a failover can never believe they own an overlapping window.
+type localWindowStore interface {
+	// load returns the last persisted high-water mark, or typeutil.ZeroTime if
+	// none has been saved yet.
+	load() (time.Time, error)
+	// save advances the high-water mark from prev to next, failing if prev no
+	// longer matches what's currently persisted.
+	save(prev, next time.Time) error
+}
+
+// etcdLocalWindowStore is the etcd-backed localWindowStore, keyed under
+// rootPath/local-tso/<id>.
+type etcdLocalWindowStore struct {
+	client *clientv3.Client
+	key    string
+}
+
+func newEtcdLocalWindowStore(client *clientv3.Client, rootPath string, allocatorID int64) *etcdLocalWindowStore {
+	return &etcdLocalWindowStore{
+		client: client,
+		key:    path.Join(rootPath, "local-tso", strconv.FormatInt(allocatorID, 10)),
+	}
+}
+
+func (s *etcdLocalWindowStore) load() (time.Time, error) {
+	data, err := etcdutil.GetValue(s.client, s.key)
+	if err != nil {
+		return typeutil.ZeroTime, err
+	}
+	if len(data) == 0 {
+		return typeutil.ZeroTime, nil
+	}
+	return typeutil.ParseTimestamp(data)
+}
+
+func (s *etcdLocalWindowStore) save(prev, next time.Time) error {
+	data := typeutil.Uint64ToBytes(uint64(next.UnixNano()))
+
+	var cmp clientv3.Cmp
+	if prev == typeutil.ZeroTime {
+		cmp = clientv3.Compare(clientv3.CreateRevision(s.key), "=", 0)
+	} else {
+		cmp = clientv3.Compare(clientv3.Value(s.key), "=", string(typeutil.Uint64ToBytes(uint64(prev.UnixNano()))))
+	}
+
+	resp, err := s.client.Txn(s.client.Ctx()).If(cmp).Then(clientv3.OpPut(s.key, string(data))).Commit()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !resp.Succeeded {
+		tsoCounter.WithLabelValues("local_window_fenced").Inc()
+		return errors.New("reserve local tso window failed, high-water mark was advanced by someone else")
+	}
+	return nil
+}
+
+// localWindow is the in-memory view of the physical-time window a
+// LocalTimestampOracle is currently allocating out of.
+type localWindow struct {
+	physical time.Time
+	logical  int64
+	expireAt time.Time
+}
+
+// LocalTimestampOracle lets a non-leader PD member allocate timestamps
+// locally, without a round trip to the leader, by reserving a window of
+// physical time from the global TimestampOracle and embedding a stable
+// allocator ID into the low bits of the logical part, i.e.
+// (physical, logical<<idBits | id).
+type LocalTimestampOracle struct {
+	allocatorID int64
+	store       localWindowStore
+	reserver    TSOWindowReserver
+
+	mu struct {
+		sync.Mutex
+		window localWindow
+	}
+}
+
+// NewLocalTimestampOracle creates a new LocalTimestampOracle that allocates
+// timestamps tagged with allocatorID, reserving windows of physical time via
+// reserver and recording its high-water mark under rootPath/local-tso/<id>.
+func NewLocalTimestampOracle(client *clientv3.Client, rootPath string, allocatorID int64, reserver TSOWindowReserver) (*LocalTimestampOracle, error) {
+	if allocatorID < 0 || allocatorID > maxAllocatorID {
+		return nil, errors.Errorf("local tso allocator id %d exceeds the %d bits reserved for it", allocatorID, localAllocatorIDBits)
+	}
+	return newLocalTimestampOracle(newEtcdLocalWindowStore(client, rootPath, allocatorID), allocatorID, reserver), nil
+}
+
+func newLocalTimestampOracle(store localWindowStore, allocatorID int64, reserver TSOWindowReserver) *LocalTimestampOracle {
+	return &LocalTimestampOracle{
+		allocatorID: allocatorID,
+		store:       store,
+		reserver:    reserver,
+	}
+}
+
+// reserveWindow asks the leader for a fresh window and persists the new
+// high-water mark before handing out any timestamps from it.
+func (l *LocalTimestampOracle) reserveWindow() (localWindow, error) {
+	prev, err := l.store.load()
+	if err != nil {
+		return localWindow{}, err
+	}
+
+	physical, err := l.reserver.ReserveTSOWindow(l.allocatorID, defaultLocalWindowSize)
+	if err != nil {
+		return localWindow{}, err
+	}
+	if physical.Before(prev) {
+		// The leader must never grant a window that goes backwards; if it
+		// does, something raced during failover and we refuse to use it.
+		return localWindow{}, errors.New("reserved local tso window is behind the last known high-water mark")
+	}
+
+	next := physical.Add(defaultLocalWindowSize)
+	if err := l.store.save(prev, next); err != nil {
+		return localWindow{}, err
+	}
+
+	return localWindow{
+		physical: physical,
+		logical:  0,
+		expireAt: next,
+	}, nil
+}
+
+// GetLocalRespTS returns a timestamp allocated from the current local window
+// without contacting the leader. As logical space within the window fills up,
+// it advances the window's physical time by a millisecond at a time, the same
+// way TimestampOracle.UpdateTimestamp does, so maxLocalLogical only bounds
+// per-millisecond throughput rather than forcing a leader round trip every
+// maxLocalLogical timestamps. It transparently renews the window as it nears
+// expiry, and falls back to the global path if the window cannot be renewed
+// or is truly exhausted.
+func (l *LocalTimestampOracle) GetLocalRespTS(global *TimestampOracle, count uint32) (pdpb.Timestamp, error) {
+	var resp pdpb.Timestamp
+	if count == 0 {
+		return resp, errors.New("tso count should be positive")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.mu.window.physical == typeutil.ZeroTime || time.Now().Add(localWindowRenewGuard).After(l.mu.window.expireAt) {
+		w, err := l.reserveWindow()
+		if err != nil {
+			log.Warn("falling back to global tso, failed to reserve local window",
+				zap.Int64("allocator-id", l.allocatorID), zap.Error(err))
+			tsoCounter.WithLabelValues("local_fallback").Inc()
+			return global.GetRespTS(count)
+		}
+		l.mu.window = w
+	}
+
+	for l.mu.window.logical+int64(count) >= maxLocalLogical {
+		next := l.mu.window.physical.Add(time.Millisecond)
+		if !next.Before(l.mu.window.expireAt) {
+			// The window has no physical time left; fall back rather than
+			// block the caller on a leader round trip.
+			tsoCounter.WithLabelValues("local_window_exhausted").Inc()
+			return global.GetRespTS(count)
+		}
+		l.mu.window.physical = next
+		l.mu.window.logical = 0
+	}
+
+	logical := l.mu.window.logical
+	l.mu.window.logical += int64(count)
+
+	resp.Physical = l.mu.window.physical.UnixNano() / int64(time.Millisecond)
+	resp.Logical = logical<<localAllocatorIDBits | l.allocatorID
+	return resp, nil
+}
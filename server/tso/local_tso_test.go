@@ -0,0 +1,202 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/pingcap/errors"
+	"github.com/tikv/pd/pkg/typeutil"
+)
+
+// memoryLocalWindowStore is a fake localWindowStore for tests: it keeps the
+// high-water mark in memory and fences save() exactly like the etcd-backed
+// implementation, failing if `prev` no longer matches what's stored.
+type memoryLocalWindowStore struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (s *memoryLocalWindowStore) load() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, nil
+}
+
+func (s *memoryLocalWindowStore) save(prev, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != prev {
+		return errors.New("fenced: high-water mark was advanced by someone else")
+	}
+	s.last = next
+	return nil
+}
+
+// fakeWindowReserver hands out consecutive windows starting at `next`,
+// advancing it by `size` on every call, unless `err` is set.
+type fakeWindowReserver struct {
+	mu   sync.Mutex
+	next time.Time
+	err  error
+}
+
+func (r *fakeWindowReserver) ReserveTSOWindow(allocatorID int64, size time.Duration) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return time.Time{}, r.err
+	}
+	physical := r.next
+	r.next = r.next.Add(size)
+	return physical, nil
+}
+
+// fakeLeadership is a leadershipChecker whose Check() result is fixed at
+// construction, so tests can fake "am I leader" without standing up a real
+// etcd-backed election.Leadership.
+type fakeLeadership struct {
+	isLeader bool
+}
+
+func (f fakeLeadership) Check() bool { return f.isLeader }
+
+func newTestGlobalOracle() *TimestampOracle {
+	o := &TimestampOracle{
+		saveInterval:  50 * time.Millisecond,
+		maxResetTSGap: func() time.Duration { return time.Hour },
+	}
+	o.setLeadership(fakeLeadership{isLeader: true})
+	current := &atomicObject{physical: time.Now()}
+	atomic.StorePointer(&o.ts, unsafe.Pointer(current))
+	return o
+}
+
+func TestLocalRespTSAdvancesPhysicalWithinWindow(t *testing.T) {
+	store := &memoryLocalWindowStore{}
+	reserver := &fakeWindowReserver{next: time.Now()}
+	l := newLocalTimestampOracle(store, 1, reserver)
+	global := newTestGlobalOracle()
+
+	var lastPhysical int64
+	sawAdvance := false
+	// maxLocalLogical timestamps exhaust a single millisecond of logical
+	// space; asking for more than that within one window must advance
+	// physical instead of falling back to the global oracle.
+	for i := 0; i < int(maxLocalLogical)*3; i++ {
+		resp, err := l.GetLocalRespTS(global, 1)
+		if err != nil {
+			t.Fatalf("GetLocalRespTS() = %v", err)
+		}
+		if lastPhysical != 0 && resp.Physical > lastPhysical {
+			sawAdvance = true
+		}
+		lastPhysical = resp.Physical
+	}
+
+	if !sawAdvance {
+		t.Fatal("GetLocalRespTS() never advanced physical time within the window; local allocation is capped at maxLocalLogical per window")
+	}
+}
+
+func TestLocalRespTSRenewsWindow(t *testing.T) {
+	store := &memoryLocalWindowStore{}
+	start := time.Now()
+	reserver := &fakeWindowReserver{next: start}
+	l := newLocalTimestampOracle(store, 1, reserver)
+	global := newTestGlobalOracle()
+
+	if _, err := l.GetLocalRespTS(global, 1); err != nil {
+		t.Fatalf("GetLocalRespTS() = %v", err)
+	}
+	firstWindow := l.mu.window.expireAt
+
+	// Force the window to look like it's about to expire so the next request
+	// triggers a renewal.
+	l.mu.Lock()
+	l.mu.window.expireAt = time.Now()
+	l.mu.Unlock()
+
+	if _, err := l.GetLocalRespTS(global, 1); err != nil {
+		t.Fatalf("GetLocalRespTS() after forced expiry = %v", err)
+	}
+	if !l.mu.window.expireAt.After(firstWindow) {
+		t.Fatalf("window was not renewed: expireAt = %v, want after %v", l.mu.window.expireAt, firstWindow)
+	}
+}
+
+func TestLocalRespTSFallsBackOnReserveFailure(t *testing.T) {
+	store := &memoryLocalWindowStore{}
+	reserver := &fakeWindowReserver{err: errors.New("leader unreachable")}
+	l := newLocalTimestampOracle(store, 1, reserver)
+	global := newTestGlobalOracle()
+
+	resp, err := l.GetLocalRespTS(global, 1)
+	if err != nil {
+		t.Fatalf("GetLocalRespTS() = %v, want fallback to succeed via global oracle", err)
+	}
+	if resp.Physical == 0 {
+		t.Fatal("GetLocalRespTS() fallback response has a zero physical part")
+	}
+}
+
+func TestLeaderWindowReserverReservesCurrentPhysical(t *testing.T) {
+	global := newTestGlobalOracle()
+	r := NewLeaderWindowReserver(global)
+
+	physical, err := r.ReserveTSOWindow(1, defaultLocalWindowSize)
+	if err != nil {
+		t.Fatalf("ReserveTSOWindow() = %v", err)
+	}
+	current := (*atomicObject)(atomic.LoadPointer(&global.ts))
+	if !physical.Equal(current.physical) {
+		t.Fatalf("ReserveTSOWindow() = %v, want the oracle's current physical time %v", physical, current.physical)
+	}
+}
+
+func TestLeaderWindowReserverErrorsWithoutLeadership(t *testing.T) {
+	global := newTestGlobalOracle()
+	global.setLeadership(fakeLeadership{isLeader: false})
+	r := NewLeaderWindowReserver(global)
+
+	if _, err := r.ReserveTSOWindow(1, defaultLocalWindowSize); err == nil {
+		t.Fatal("ReserveTSOWindow() without leadership = nil error, want error")
+	}
+}
+
+func TestLocalWindowStoreFencesConcurrentHolders(t *testing.T) {
+	store := &memoryLocalWindowStore{}
+
+	base := time.Now()
+	if err := store.save(typeutil.ZeroTime, base); err != nil {
+		t.Fatalf("save() initial window = %v", err)
+	}
+
+	// A second holder of the same allocator ID (e.g. after a failover) that
+	// still believes the high-water mark is at the zero value must not be
+	// able to clobber what's already there.
+	if err := store.save(typeutil.ZeroTime, base.Add(time.Second)); err == nil {
+		t.Fatal("save() with a stale prev succeeded, want fencing error")
+	}
+
+	// The legitimate holder, using the correct prev, must still be able to
+	// advance the window.
+	if err := store.save(base, base.Add(defaultLocalWindowSize)); err != nil {
+		t.Fatalf("save() with correct prev = %v", err)
+	}
+}
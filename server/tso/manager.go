@@ -0,0 +1,229 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/log"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+)
+
+// legacyKeyspaceID is the keyspace ID that keeps using the original,
+// un-namespaced rootPath/timestamp key, so upgrading a single-tenant
+// deployment to a keyspace-aware one doesn't lose its TSO high-water mark.
+const legacyKeyspaceID = uint32(0)
+
+// keyspaceOracle pairs a keyspace's TimestampOracle with the sync.Once that
+// serializes its first SyncTimestamp call, so concurrent first requests for
+// the same keyspace can't race two SyncTimestamp calls against each other and
+// risk a non-monotonic timestamp.
+type keyspaceOracle struct {
+	oracle *TimestampOracle
+
+	once    sync.Once
+	syncErr error
+	// synced is set once syncErr has been observed to be nil, so
+	// UpdateTimestamp can cheaply skip keyspaces that never finished syncing.
+	synced int32
+}
+
+// TSOManager owns one TimestampOracle per keyspace, so multi-tenant clients
+// get strictly monotonic timestamps per keyspace without contending on a
+// single global oracle.
+type TSOManager struct {
+	client   *clientv3.Client
+	rootPath string
+	member   string
+
+	saveInterval  time.Duration
+	maxResetTSGap func() time.Duration
+
+	mu struct {
+		sync.RWMutex
+		leadership leadershipChecker
+		keyspaces  map[uint32]*keyspaceOracle
+	}
+}
+
+// NewTSOManager creates a TSOManager whose keyspace oracles all share
+// saveInterval and maxResetTSGap.
+func NewTSOManager(client *clientv3.Client, rootPath string, member string, saveInterval time.Duration, maxResetTSGap func() time.Duration) *TSOManager {
+	m := &TSOManager{
+		client:        client,
+		rootPath:      rootPath,
+		member:        member,
+		saveInterval:  saveInterval,
+		maxResetTSGap: maxResetTSGap,
+	}
+	m.mu.keyspaces = make(map[uint32]*keyspaceOracle)
+	return m
+}
+
+func (m *TSOManager) keyspaceRootPath(keyspaceID uint32) string {
+	if keyspaceID == legacyKeyspaceID {
+		return m.rootPath
+	}
+	return path.Join(m.rootPath, "keyspaces", strconv.FormatUint(uint64(keyspaceID), 10))
+}
+
+// CreateKeyspaceTSO creates the TimestampOracle for keyspaceID if it doesn't
+// already exist. It does not sync the oracle; that happens lazily, and only
+// once, on the keyspace's first GetRespTS, so that creating many keyspaces
+// never blocks on etcd round trips.
+//
+// This is the call-site-ready method behind the admin-facing
+// CreateKeyspaceTSO RPC; server/grpc_service.go's handler for it (not part
+// of this checkout) should call straight through to this.
+func (m *TSOManager) CreateKeyspaceTSO(keyspaceID uint32) error {
+	_, err := m.getOrCreateKeyspace(keyspaceID)
+	return err
+}
+
+func (m *TSOManager) getOrCreateKeyspace(keyspaceID uint32) (*keyspaceOracle, error) {
+	m.mu.RLock()
+	k, ok := m.mu.keyspaces[keyspaceID]
+	m.mu.RUnlock()
+	if ok {
+		return k, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.mu.keyspaces[keyspaceID]; ok {
+		return k, nil
+	}
+
+	storage := NewEtcdTSOStorage(m.client, m.keyspaceRootPath(keyspaceID), m.member)
+	o := NewTimestampOracle(storage, m.saveInterval, m.maxResetTSGap)
+	k = &keyspaceOracle{oracle: o}
+	m.mu.keyspaces[keyspaceID] = k
+	return k, nil
+}
+
+// ensureSynced runs SyncTimestamp for k exactly once under the current
+// leadership. Concurrent callers for the same keyspace block on the same
+// sync.Once and all observe its result, instead of racing independent
+// SyncTimestamp calls against the same oracle.
+func (m *TSOManager) ensureSynced(k *keyspaceOracle) error {
+	m.mu.RLock()
+	leadership := m.mu.leadership
+	m.mu.RUnlock()
+	if leadership == nil {
+		return errors.New("can not sync keyspace tso, no leadership")
+	}
+
+	k.once.Do(func() {
+		k.syncErr = k.oracle.SyncTimestamp(leadership)
+		if k.syncErr == nil {
+			atomic.StoreInt32(&k.synced, 1)
+		}
+	})
+	return k.syncErr
+}
+
+// SetLeadership records the leadership each keyspace oracle should sync
+// against, and marks every keyspace for re-sync before it next serves a
+// timestamp.
+func (m *TSOManager) SetLeadership(leadership leadershipChecker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mu.leadership = leadership
+	for id, k := range m.mu.keyspaces {
+		m.mu.keyspaces[id] = &keyspaceOracle{oracle: k.oracle}
+	}
+}
+
+// GetRespTS returns a timestamp from keyspaceID's oracle, creating and lazily
+// syncing it first if necessary.
+//
+// This is the call-site-ready replacement for a bare TimestampOracle.GetRespTS
+// call in a Tso stream handler that wants per-keyspace timestamps:
+// server/grpc_service.go's (not part of this checkout) Tso handler should
+// derive keyspaceID from the request's KeyspaceID field and call this instead.
+func (m *TSOManager) GetRespTS(keyspaceID uint32, count uint32) (pdpb.Timestamp, error) {
+	k, err := m.getOrCreateKeyspace(keyspaceID)
+	if err != nil {
+		return pdpb.Timestamp{}, err
+	}
+	if err := m.ensureSynced(k); err != nil {
+		return pdpb.Timestamp{}, err
+	}
+	return k.oracle.GetRespTS(count)
+}
+
+// ResetKeyspaceTSO resets keyspaceID's oracle and marks it for re-sync on its
+// next request.
+//
+// This is the call-site-ready method behind the admin-facing ResetKeyspaceTSO
+// RPC; server/grpc_service.go's handler for it (not part of this checkout)
+// should call straight through to this.
+func (m *TSOManager) ResetKeyspaceTSO(keyspaceID uint32) error {
+	m.mu.Lock()
+	k, ok := m.mu.keyspaces[keyspaceID]
+	if ok {
+		m.mu.keyspaces[keyspaceID] = &keyspaceOracle{oracle: k.oracle}
+	}
+	m.mu.Unlock()
+	if !ok {
+		return errors.Errorf("keyspace %d has no tso allocator", keyspaceID)
+	}
+	k.oracle.ResetTimestamp()
+	return nil
+}
+
+// ListKeyspaceTSO returns the IDs of every keyspace with an active oracle.
+//
+// This is the call-site-ready method behind the admin-facing ListKeyspaceTSO
+// RPC; server/grpc_service.go's handler for it (not part of this checkout)
+// should call straight through to this.
+func (m *TSOManager) ListKeyspaceTSO() []uint32 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]uint32, 0, len(m.mu.keyspaces))
+	for id := range m.mu.keyspaces {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// UpdateTimestamp advances every keyspace oracle that has finished its first
+// sync by one tick. It keeps going on error so one stuck keyspace doesn't
+// stall the rest, and returns the last error it saw, if any.
+func (m *TSOManager) UpdateTimestamp() error {
+	m.mu.RLock()
+	keyspaces := make(map[uint32]*keyspaceOracle, len(m.mu.keyspaces))
+	for id, k := range m.mu.keyspaces {
+		if atomic.LoadInt32(&k.synced) == 1 {
+			keyspaces[id] = k
+		}
+	}
+	m.mu.RUnlock()
+
+	var lastErr error
+	for id, k := range keyspaces {
+		if err := k.oracle.UpdateTimestamp(); err != nil {
+			log.Error("failed to update keyspace tso", zap.Uint32("keyspace-id", id), zap.Error(err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
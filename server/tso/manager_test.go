@@ -0,0 +1,134 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestTSOManager() *TSOManager {
+	return NewTSOManager(nil, "/pd", "member1", 3*time.Second, func() time.Duration { return time.Hour })
+}
+
+func TestKeyspaceRootPath(t *testing.T) {
+	m := newTestTSOManager()
+
+	if got, want := m.keyspaceRootPath(legacyKeyspaceID), "/pd"; got != want {
+		t.Fatalf("keyspaceRootPath(legacy) = %q, want %q", got, want)
+	}
+	if got, want := m.keyspaceRootPath(7), "/pd/keyspaces/7"; got != want {
+		t.Fatalf("keyspaceRootPath(7) = %q, want %q", got, want)
+	}
+}
+
+func TestCreateAndListKeyspaceTSO(t *testing.T) {
+	m := newTestTSOManager()
+
+	for _, id := range []uint32{legacyKeyspaceID, 1, 2} {
+		if err := m.CreateKeyspaceTSO(id); err != nil {
+			t.Fatalf("CreateKeyspaceTSO(%d) = %v", id, err)
+		}
+	}
+	// Creating the same keyspace twice should not error or duplicate it.
+	if err := m.CreateKeyspaceTSO(1); err != nil {
+		t.Fatalf("CreateKeyspaceTSO(1) again = %v", err)
+	}
+
+	ids := m.ListKeyspaceTSO()
+	if len(ids) != 3 {
+		t.Fatalf("ListKeyspaceTSO() = %v, want 3 entries", ids)
+	}
+}
+
+func TestResetUnknownKeyspaceTSO(t *testing.T) {
+	m := newTestTSOManager()
+	if err := m.ResetKeyspaceTSO(42); err == nil {
+		t.Fatalf("ResetKeyspaceTSO(42) on unknown keyspace = nil, want error")
+	}
+}
+
+func TestGetRespTSWithoutLeadershipErrors(t *testing.T) {
+	m := newTestTSOManager()
+	if _, err := m.GetRespTS(3, 1); err == nil {
+		t.Fatal("GetRespTS() without leadership set = nil error, want error")
+	}
+}
+
+func TestGetRespTSSyncsAndReturnsTimestamp(t *testing.T) {
+	m := newTestTSOManager()
+
+	k, err := m.getOrCreateKeyspace(4)
+	if err != nil {
+		t.Fatalf("getOrCreateKeyspace(4) = %v", err)
+	}
+	k.oracle.storage = NewMemoryTSOStorage()
+	m.SetLeadership(fakeLeadership{isLeader: true})
+
+	resp, err := m.GetRespTS(4, 1)
+	if err != nil {
+		t.Fatalf("GetRespTS() = %v", err)
+	}
+	if resp.Physical == 0 {
+		t.Fatal("GetRespTS() returned a zero physical part")
+	}
+}
+
+// countingTSOStorage wraps a TSOStorage and counts how many times Load is
+// called, so tests can assert SyncTimestamp only ran once despite concurrent
+// callers.
+type countingTSOStorage struct {
+	TSOStorage
+	loads int32
+}
+
+func (s *countingTSOStorage) Load() (time.Time, error) {
+	atomic.AddInt32(&s.loads, 1)
+	return s.TSOStorage.Load()
+}
+
+func TestEnsureSyncedSerializesConcurrentFirstSync(t *testing.T) {
+	m := newTestTSOManager()
+	m.SetLeadership(fakeLeadership{isLeader: true})
+
+	k, err := m.getOrCreateKeyspace(9)
+	if err != nil {
+		t.Fatalf("getOrCreateKeyspace(9) = %v", err)
+	}
+	storage := &countingTSOStorage{TSOStorage: NewMemoryTSOStorage()}
+	k.oracle.storage = storage
+
+	const concurrency = 50
+	var wg sync.WaitGroup
+	errs := make([]error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.ensureSynced(k)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("ensureSynced()[%d] = %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&storage.loads); got != 1 {
+		t.Fatalf("storage.Load() called %d times by concurrent first syncs, want exactly 1", got)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/tikv/pd/pkg/etcdutil"
+	"github.com/tikv/pd/pkg/typeutil"
+	"github.com/tikv/pd/server/election"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// TSOStorage is the persistence layer for a TimestampOracle's high-water
+// mark. Extracting it decouples the TSO logic from etcd, so it can run on
+// top of alternative meta stores, or embedded in another service entirely.
+type TSOStorage interface {
+	// Load returns the last persisted timestamp, or typeutil.ZeroTime if none
+	// has been saved yet.
+	Load() (time.Time, error)
+	// SaveIfLeader persists ts, but only while the caller still holds
+	// whatever leadership the storage implementation requires; it returns an
+	// error if that leadership was lost.
+	SaveIfLeader(ts time.Time) error
+}
+
+// leadershipSetter is implemented by TSOStorage backends that need to be told
+// about leadership changes, such as EtcdTSOStorage fencing its writes on the
+// current PD leader. Backends with no such notion, like the in-memory and
+// file-backed implementations, don't need to implement it.
+type leadershipSetter interface {
+	setLeadership(leadership *election.Leadership)
+}
+
+// EtcdTSOStorage is the etcd-backed TSOStorage, and the one PD has always
+// used: the high-water mark is stored under rootPath/timestamp and writes are
+// fenced on the caller still being the elected leader at rootPath/leader.
+type EtcdTSOStorage struct {
+	client   *clientv3.Client
+	rootPath string
+	member   string
+
+	leadership atomic.Value // stores *election.Leadership
+}
+
+// NewEtcdTSOStorage creates an EtcdTSOStorage persisting under
+// rootPath/timestamp, fencing writes on member still holding the leadership
+// recorded at rootPath/leader.
+func NewEtcdTSOStorage(client *clientv3.Client, rootPath string, member string) *EtcdTSOStorage {
+	return &EtcdTSOStorage{
+		client:   client,
+		rootPath: rootPath,
+		member:   member,
+	}
+}
+
+func (s *EtcdTSOStorage) getTimestampPath() string {
+	return path.Join(s.rootPath, "timestamp")
+}
+
+func (s *EtcdTSOStorage) getLeadership() *election.Leadership {
+	leadership := s.leadership.Load()
+	if leadership == nil {
+		return nil
+	}
+	return leadership.(*election.Leadership)
+}
+
+func (s *EtcdTSOStorage) setLeadership(leadership *election.Leadership) {
+	s.leadership.Store(leadership)
+}
+
+// Load implements TSOStorage.
+func (s *EtcdTSOStorage) Load() (time.Time, error) {
+	data, err := etcdutil.GetValue(s.client, s.getTimestampPath())
+	if err != nil {
+		return typeutil.ZeroTime, err
+	}
+	if len(data) == 0 {
+		return typeutil.ZeroTime, nil
+	}
+	return typeutil.ParseTimestamp(data)
+}
+
+// SaveIfLeader implements TSOStorage. If ts is the first value ever saved, we
+// think the timestamp doesn't exist yet, so it's created; otherwise it's
+// updated.
+func (s *EtcdTSOStorage) SaveIfLeader(ts time.Time) error {
+	key := s.getTimestampPath()
+	data := typeutil.Uint64ToBytes(uint64(ts.UnixNano()))
+	leaderPath := path.Join(s.rootPath, "leader")
+	resp, err := s.getLeadership().
+		LeaderTxn(clientv3.Compare(clientv3.Value(leaderPath), "=", s.member)).
+		Then(clientv3.OpPut(key, string(data))).
+		Commit()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !resp.Succeeded {
+		return errors.New("save timestamp failed, maybe we lost leader")
+	}
+	return nil
+}
+
+// memoryTSOStorage is a process-local TSOStorage with no notion of
+// leadership, useful for tests that exercise TimestampOracle without an etcd
+// cluster.
+type memoryTSOStorage struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// NewMemoryTSOStorage creates a TSOStorage that simply keeps the high-water
+// mark in memory. SaveIfLeader always succeeds, since there is no leader to
+// lose.
+func NewMemoryTSOStorage() TSOStorage {
+	return &memoryTSOStorage{}
+}
+
+func (s *memoryTSOStorage) Load() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, nil
+}
+
+func (s *memoryTSOStorage) SaveIfLeader(ts time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = ts
+	return nil
+}
+
+// fileTSOStorage persists the high-water mark to a single file. It does not
+// fence writes against another holder of the same file, so it is only
+// suitable for a single-process PD instance running without etcd, not for a
+// replicated deployment.
+type fileTSOStorage struct {
+	mu       sync.Mutex
+	filePath string
+}
+
+// NewFileTSOStorage creates a TSOStorage backed by the file at filePath.
+func NewFileTSOStorage(filePath string) TSOStorage {
+	return &fileTSOStorage{filePath: filePath}
+}
+
+func (s *fileTSOStorage) Load() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.filePath)
+	if os.IsNotExist(err) {
+		return typeutil.ZeroTime, nil
+	}
+	if err != nil {
+		return typeutil.ZeroTime, errors.WithStack(err)
+	}
+	if len(data) == 0 {
+		return typeutil.ZeroTime, nil
+	}
+	return typeutil.ParseTimestamp(data)
+}
+
+func (s *fileTSOStorage) SaveIfLeader(ts time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := typeutil.Uint64ToBytes(uint64(ts.UnixNano()))
+	return errors.WithStack(ioutil.WriteFile(s.filePath, data, 0600))
+}
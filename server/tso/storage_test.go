@@ -0,0 +1,59 @@
+// Copyright 2016 TiKV Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tso
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStorageRoundTrip(t *testing.T, storage TSOStorage) {
+	last, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load() on empty storage: %v", err)
+	}
+	if !last.IsZero() {
+		t.Fatalf("Load() on empty storage = %v, want zero time", last)
+	}
+
+	want := time.Now().Round(0)
+	if err := storage.SaveIfLeader(want); err != nil {
+		t.Fatalf("SaveIfLeader() = %v", err)
+	}
+
+	got, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if !got.Equal(want) {
+		t.Fatalf("Load() = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryTSOStorage(t *testing.T) {
+	testStorageRoundTrip(t, NewMemoryTSOStorage())
+}
+
+func TestFileTSOStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pd-tso-storage-test")
+	if err != nil {
+		t.Fatalf("TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStorageRoundTrip(t, NewFileTSOStorage(filepath.Join(dir, "timestamp")))
+}
@@ -14,7 +14,6 @@
 package tso
 
 import (
-	"path"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -24,11 +23,9 @@ import (
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/log"
 	"github.com/tikv/pd/pkg/errs"
-	"github.com/tikv/pd/pkg/etcdutil"
-	"github.com/tikv/pd/pkg/tsoutil"
+	"github.com/tikv/pd/pkg/oracle"
 	"github.com/tikv/pd/pkg/typeutil"
 	"github.com/tikv/pd/server/election"
-	"go.etcd.io/etcd/clientv3"
 	"go.uber.org/zap"
 )
 
@@ -36,47 +33,77 @@ const (
 	// UpdateTimestampStep is used to update timestamp.
 	UpdateTimestampStep  = 50 * time.Millisecond
 	updateTimestampGuard = time.Millisecond
-	maxLogical           = int64(1 << 18)
+	// maxLogical is kept as an alias of oracle.MaxLogical so call sites in
+	// this package don't need to change; the bit layout itself now lives in
+	// the oracle package.
+	maxLogical = oracle.MaxLogical
 )
 
+// leadershipChecker is satisfied by anything that can report whether the
+// caller still holds the leadership a TSO request requires. *election.Leadership
+// is the production implementation; extracting it lets tests fake "am I
+// leader" the same way TSOStorage lets them fake persistence, instead of
+// standing up a real etcd-backed election.Leadership.
+type leadershipChecker interface {
+	Check() bool
+}
+
+// noLeader is the leadershipChecker stored by setLeadership(nil), so
+// getLeadership only ever has to treat a literal nil as "never set at all".
+type noLeader struct{}
+
+func (noLeader) Check() bool { return false }
+
 // TimestampOracle is used to maintain the logic of tso.
 type TimestampOracle struct {
 	// leadership is used to check the current PD server's leadership
-	// to determine whether a tso request could be processed and
-	// it's stored as *election.Leadership
+	// to determine whether a tso request could be processed and it's
+	// stored as a leadershipChecker.
 	leadership atomic.Value
 	// For tso, set after pd becomes leader.
 	ts            unsafe.Pointer
 	lastSavedTime atomic.Value
-	rootPath      string
-	member        string
-	client        *clientv3.Client
+	storage       TSOStorage
 	saveInterval  time.Duration
 	maxResetTSGap func() time.Duration
 }
 
 // NewTimestampOracle creates a new TimestampOracle.
 // TODO: remove saveInterval
-func NewTimestampOracle(client *clientv3.Client, rootPath string, member string, saveInterval time.Duration, maxResetTSGap func() time.Duration) *TimestampOracle {
+func NewTimestampOracle(storage TSOStorage, saveInterval time.Duration, maxResetTSGap func() time.Duration) *TimestampOracle {
 	return &TimestampOracle{
-		rootPath:      rootPath,
-		client:        client,
+		storage:       storage,
 		saveInterval:  saveInterval,
 		maxResetTSGap: maxResetTSGap,
-		member:        member,
 	}
 }
 
-func (t *TimestampOracle) getLeadership() *election.Leadership {
+func (t *TimestampOracle) getLeadership() leadershipChecker {
 	leadership := t.leadership.Load()
 	if leadership == nil {
 		return nil
 	}
-	return leadership.(*election.Leadership)
+	return leadership.(leadershipChecker)
 }
 
-func (t *TimestampOracle) setLeadership(leadership *election.Leadership) {
+func (t *TimestampOracle) setLeadership(leadership leadershipChecker) {
+	if leadership == nil {
+		leadership = noLeader{}
+	}
 	t.leadership.Store(leadership)
+	if el, ok := leadership.(*election.Leadership); ok {
+		if s, ok := t.storage.(leadershipSetter); ok {
+			s.setLeadership(el)
+		}
+	}
+}
+
+// isLeader is the single choke point GetRespTS and ResetUserTimestamp use to
+// decide whether this oracle may still serve timestamps; it's nil-safe so
+// callers don't each have to guard against a leadership that was never set.
+func (t *TimestampOracle) isLeader() bool {
+	leadership := t.getLeadership()
+	return leadership != nil && leadership.Check()
 }
 
 type atomicObject struct {
@@ -84,45 +111,18 @@ type atomicObject struct {
 	logical  int64
 }
 
-func (t *TimestampOracle) getTimestampPath() string {
-	return path.Join(t.rootPath, "timestamp")
-}
-
-func (t *TimestampOracle) loadTimestamp() (time.Time, error) {
-	data, err := etcdutil.GetValue(t.client, t.getTimestampPath())
-	if err != nil {
-		return typeutil.ZeroTime, err
-	}
-	if len(data) == 0 {
-		return typeutil.ZeroTime, nil
-	}
-	return typeutil.ParseTimestamp(data)
-}
-
 // save timestamp, if lastTs is 0, we think the timestamp doesn't exist, so create it,
 // otherwise, update it.
 func (t *TimestampOracle) saveTimestamp(ts time.Time) error {
-	key := t.getTimestampPath()
-	data := typeutil.Uint64ToBytes(uint64(ts.UnixNano()))
-	leaderPath := path.Join(t.rootPath, "leader")
-	resp, err := t.getLeadership().
-		LeaderTxn(clientv3.Compare(clientv3.Value(leaderPath), "=", t.member)).
-		Then(clientv3.OpPut(key, string(data))).
-		Commit()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if !resp.Succeeded {
-		return errors.New("save timestamp failed, maybe we lost leader")
+	if err := t.storage.SaveIfLeader(ts); err != nil {
+		return err
 	}
-
 	t.lastSavedTime.Store(ts)
-
 	return nil
 }
 
 // SyncTimestamp is used to synchronize the timestamp.
-func (t *TimestampOracle) SyncTimestamp(leadership *election.Leadership) error {
+func (t *TimestampOracle) SyncTimestamp(leadership leadershipChecker) error {
 	tsoCounter.WithLabelValues("sync").Inc()
 
 	t.setLeadership(leadership)
@@ -131,7 +131,7 @@ func (t *TimestampOracle) SyncTimestamp(leadership *election.Leadership) error {
 		time.Sleep(time.Second)
 	})
 
-	last, err := t.loadTimestamp()
+	last, err := t.storage.Load()
 	if err != nil {
 		return err
 	}
@@ -167,11 +167,11 @@ func (t *TimestampOracle) SyncTimestamp(leadership *election.Leadership) error {
 
 // ResetUserTimestamp update the physical part with specified tso.
 func (t *TimestampOracle) ResetUserTimestamp(tso uint64) error {
-	if !t.getLeadership().Check() {
+	if !t.isLeader() {
 		tsoCounter.WithLabelValues("err_lease_reset_ts").Inc()
 		return errors.New("Setup timestamp failed, lease expired")
 	}
-	physical, _ := tsoutil.ParseTS(tso)
+	physical := oracle.GetTimeFromTS(tso)
 	next := physical.Add(time.Millisecond)
 	prev := (*atomicObject)(atomic.LoadPointer(&t.ts))
 
@@ -294,7 +294,7 @@ func (t *TimestampOracle) GetRespTS(count uint32) (pdpb.Timestamp, error) {
 		current := (*atomicObject)(atomic.LoadPointer(&t.ts))
 		if current == nil || current.physical == typeutil.ZeroTime {
 			// If it's leader, maybe SyncTimestamp hasn't completed yet
-			if t.getLeadership().Check() {
+			if t.isLeader() {
 				log.Info("sync hasn't completed yet, wait for a while")
 				time.Sleep(200 * time.Millisecond)
 				continue
@@ -303,9 +303,9 @@ func (t *TimestampOracle) GetRespTS(count uint32) (pdpb.Timestamp, error) {
 			return pdpb.Timestamp{}, errors.New("can not get timestamp, may be not leader")
 		}
 
-		resp.Physical = current.physical.UnixNano() / int64(time.Millisecond)
+		resp.Physical = oracle.GetPhysical(current.physical)
 		resp.Logical = atomic.AddInt64(&current.logical, int64(count))
-		if resp.Logical >= maxLogical {
+		if resp.Logical >= oracle.MaxLogical {
 			log.Error("logical part outside of max logical interval, please check ntp time",
 				zap.Reflect("response", resp),
 				zap.Int("retry-count", i), zap.Error(errs.ErrLogicOverflow.FastGenByArgs()))
@@ -314,7 +314,7 @@ func (t *TimestampOracle) GetRespTS(count uint32) (pdpb.Timestamp, error) {
 			continue
 		}
 		// In case lease expired after the first check.
-		if !t.getLeadership().Check() {
+		if !t.isLeader() {
 			return pdpb.Timestamp{}, errors.New("alloc timestamp failed, lease expired")
 		}
 		return resp, nil